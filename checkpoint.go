@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// defaultCheckpointFile is the checkpoint written in the current directory
+// when --append is used, recording generation progress per collection so an
+// interrupted or crashed run can resume without dropping existing data
+const defaultCheckpointFile = ".mgodatagen-checkpoint.json"
+
+// CollectionCheckpoint records how far generation got for one collection
+type CollectionCheckpoint struct {
+	// Count is the number of documents already generated for this collection
+	Count int `json:"count"`
+	// BatchIndex is the index of the next batch to generate, used to derive
+	// the correct per-batch seed on resume
+	BatchIndex int `json:"batchIndex"`
+}
+
+// Checkpoint is the on-disk state used by --append to resume an interrupted
+// or crashed load without duplicating or dropping documents
+type Checkpoint struct {
+	mu          sync.Mutex
+	path        string
+	Collections map[string]CollectionCheckpoint `json:"collections"`
+}
+
+// loadCheckpoint reads path if it exists, or returns an empty Checkpoint
+// ready to be populated if it doesn't
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	cp := &Checkpoint{path: path, Collections: make(map[string]CollectionCheckpoint)}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read checkpoint file %s:\n\tcause: %s", path, err.Error())
+	}
+	if err := json.Unmarshal(raw, cp); err != nil {
+		return nil, fmt.Errorf("couldn't parse checkpoint file %s:\n\tcause: %s", path, err.Error())
+	}
+	return cp, nil
+}
+
+// progress returns the recorded checkpoint for a namespace, or a zero value
+// if generation hasn't started for it yet
+func (cp *Checkpoint) progress(ns string) CollectionCheckpoint {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.Collections[ns]
+}
+
+// advance records that a batch of n documents was successfully inserted for
+// ns at batchIndex, and persists the checkpoint to disk. The whole file is
+// rewritten every call: checkpoints stay small and correctness after a crash
+// matters more than avoiding the extra IO here
+func (cp *Checkpoint) advance(ns string, n, batchIndex int) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	c := cp.Collections[ns]
+	c.Count += n
+	if batchIndex+1 > c.BatchIndex {
+		c.BatchIndex = batchIndex + 1
+	}
+	cp.Collections[ns] = c
+	raw, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal checkpoint:\n\tcause: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(cp.path, raw, 0644); err != nil {
+		return fmt.Errorf("couldn't write checkpoint file %s:\n\tcause: %s", cp.path, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCheckpointMissingFile(t *testing.T) {
+	cp, err := loadCheckpoint(filepath.Join(t.TempDir(), "does-not-exist.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cp.Collections) != 0 {
+		t.Fatalf("expected an empty checkpoint, got %v", cp.Collections)
+	}
+}
+
+func TestCheckpointAdvanceAccumulatesCount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ns := "test.coll"
+	if err := cp.advance(ns, 1000, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cp.advance(ns, 1000, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := cp.progress(ns)
+	if got.Count != 2000 {
+		t.Errorf("Count = %d, want 2000", got.Count)
+	}
+	if got.BatchIndex != 2 {
+		t.Errorf("BatchIndex = %d, want 2", got.BatchIndex)
+	}
+}
+
+func TestCheckpointAdvancePersistsAcrossLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ns := "test.coll"
+	if err := cp.advance(ns, 1000, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reloaded, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading checkpoint: %v", err)
+	}
+	got := reloaded.progress(ns)
+	if got.Count != 1000 || got.BatchIndex != 1 {
+		t.Fatalf("got %+v, want Count=1000 BatchIndex=1", got)
+	}
+}
+
+// TestCheckpointAdvanceBatchIndexNeverRegresses guards the ordering
+// assumption insertInDB relies on: with a single inserting goroutine,
+// batches complete and advance() in index order, so BatchIndex only moves
+// forward by one per batch and never skips or regresses
+func TestCheckpointAdvanceBatchIndexNeverRegresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ns := "test.coll"
+	for i := 0; i < 5; i++ {
+		if err := cp.advance(ns, 100, i); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := cp.progress(ns).BatchIndex; got != i+1 {
+			t.Fatalf("after batch %d: BatchIndex = %d, want %d", i, got, i+1)
+		}
+	}
+}
+
+func TestCheckpointProgressUnknownNamespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := cp.progress("test.unknown")
+	if got.Count != 0 || got.BatchIndex != 0 {
+		t.Fatalf("expected zero-value progress for an unseen namespace, got %+v", got)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors exposed at --metrics-addr, all
+// labeled by collection so throughput and errors can be broken down per
+// collection on a single dashboard
+type metrics struct {
+	docsGenerated    *prometheus.CounterVec
+	docsInserted     *prometheus.CounterVec
+	bulkErrors       *prometheus.CounterVec
+	generatorLatency *prometheus.HistogramVec
+	recordBufferLen  *prometheus.GaugeVec
+}
+
+// newMetrics creates and registers the collectors on a fresh registry, so
+// running mgodatagen as a library doesn't pollute the default registry
+func newMetrics() (*metrics, *prometheus.Registry) {
+	reg := prometheus.NewRegistry()
+	m := &metrics{
+		docsGenerated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mgodatagen_docs_generated_total",
+			Help: "Number of documents generated, per collection",
+		}, []string{"collection"}),
+		docsInserted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mgodatagen_docs_inserted_total",
+			Help: "Number of documents durably written to the sink, per collection",
+		}, []string{"collection"}),
+		bulkErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mgodatagen_bulk_errors_total",
+			Help: "Number of failed inserts, per collection",
+		}, []string{"collection"}),
+		generatorLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "mgodatagen_generator_batch_seconds",
+			Help: "Time to generate one batch of documents, per collection",
+		}, []string{"collection"}),
+		recordBufferLen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mgodatagen_record_buffer_length",
+			Help: "Current number of generated batches buffered and waiting to be inserted, per collection",
+		}, []string{"collection"}),
+	}
+	reg.MustRegister(m.docsGenerated, m.docsInserted, m.bulkErrors, m.generatorLatency, m.recordBufferLen)
+	return m, reg
+}
+
+// serveMetrics starts an HTTP server exposing reg on addr at /metrics in the
+// background. It runs until the process exits; a failure to bind is logged
+// but doesn't stop generation
+func serveMetrics(addr string, reg *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logEvent("error", "metrics server stopped", map[string]interface{}{"cause": err.Error()})
+		}
+	}()
+	logEvent("info", "metrics server listening", map[string]interface{}{"addr": addr})
+}
+
+// logEvent emits a single structured JSON log line to stdout, in the spirit
+// of mongo-tools' log.Logvf, so multi-hour loads against sharded clusters
+// can be parsed by log aggregators instead of relying on a progress bar
+func logEvent(level, msg string, fields map[string]interface{}) {
+	entry := make(map[string]interface{}, len(fields)+3)
+	entry["t"] = time.Now().Format(time.RFC3339)
+	entry["level"] = level
+	entry["msg"] = msg
+	for k, v := range fields {
+		entry[k] = v
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "{\"level\":\"error\",\"msg\":\"couldn't marshal log entry: %s\"}\n", err.Error())
+		return
+	}
+	fmt.Println(string(raw))
+}
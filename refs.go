@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// refSampleSize caps how many values are kept in the refCache for a single
+// referenced field, to bound memory use on large collections
+const refSampleSize = 1000
+
+// ReferenceSpec populates a field by sampling values of RefField from an
+// already-generated collection, letting one collection reference another's
+// _ids (or any other field) to build relational-style datasets
+type ReferenceSpec struct {
+	// Database the referenced collection lives in. Defaults to this collection's database
+	Database string `json:"database"`
+	// Collection to sample values from. Must be generated earlier in the same run
+	Collection string `json:"collection"`
+	// RefField is the field to sample from the referenced collection. Defaults to "_id"
+	RefField string `json:"refField"`
+}
+
+// PipelineSpec populates a field by running an aggregation pipeline against
+// an already-generated collection once, and assigning the resulting value to
+// every document generated for this collection
+type PipelineSpec struct {
+	// Database the referenced collection lives in. Defaults to this collection's database
+	Database string `json:"database"`
+	// Collection to run the pipeline against. Must be generated earlier in the same run
+	Collection string `json:"collection"`
+	// Pipeline is the aggregation pipeline to run, as in db.collection.aggregate(pipeline)
+	Pipeline []bson.M `json:"pipeline"`
+	// Field is the field to read from the single result document
+	Field string `json:"field"`
+}
+
+// ns returns the "database.collection" namespace a ReferenceSpec points to,
+// defaulting the database to the referencing collection's own database
+func (r ReferenceSpec) ns(defaultDB string) string {
+	db := r.Database
+	if db == "" {
+		db = defaultDB
+	}
+	return db + "." + r.Collection
+}
+
+func (p PipelineSpec) ns(defaultDB string) string {
+	db := p.Database
+	if db == "" {
+		db = defaultDB
+	}
+	return db + "." + p.Collection
+}
+
+// dependsOn returns the namespaces of every collection that must be
+// generated before coll, derived from its `references` and `pipelines` fields
+func (coll *Collection) dependsOn() []string {
+	seen := make(map[string]bool)
+	var deps []string
+	add := func(ns string) {
+		if !seen[ns] {
+			seen[ns] = true
+			deps = append(deps, ns)
+		}
+	}
+	for _, ref := range coll.References {
+		add(ref.ns(coll.DB))
+	}
+	for _, p := range coll.Pipelines {
+		add(p.ns(coll.DB))
+	}
+	return deps
+}
+
+// orderCollections sorts collectionList so that every collection referenced
+// through `references` or `pipelines` comes before the collection that
+// depends on it (topological sort, Kahn's algorithm). Returns an error if a
+// dependency points to an unknown collection or if there's a cycle
+func orderCollections(collectionList []Collection) ([]Collection, error) {
+	index := make(map[string]int, len(collectionList))
+	for i, c := range collectionList {
+		index[c.DB+"."+c.Name] = i
+	}
+	dependents := make(map[int][]int)
+	inDegree := make([]int, len(collectionList))
+	for i, c := range collectionList {
+		for _, dep := range c.dependsOn() {
+			j, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("collection %s references unknown collection %s in 'references'/'pipelines'", c.Name, dep)
+			}
+			dependents[j] = append(dependents[j], i)
+			inDegree[i]++
+		}
+	}
+	queue := make([]int, 0, len(collectionList))
+	for i := range collectionList {
+		if inDegree[i] == 0 {
+			queue = append(queue, i)
+		}
+	}
+	ordered := make([]Collection, 0, len(collectionList))
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		ordered = append(ordered, collectionList[i])
+		for _, j := range dependents[i] {
+			inDegree[j]--
+			if inDegree[j] == 0 {
+				queue = append(queue, j)
+			}
+		}
+	}
+	if len(ordered) != len(collectionList) {
+		return nil, fmt.Errorf("circular reference detected between collections, check 'references'/'pipelines' fields")
+	}
+	return ordered, nil
+}
+
+// neededRefFields scans every collection's `references` and returns, for
+// each referenced namespace, the set of fields that must be cached while
+// that collection is generated
+func neededRefFields(collectionList []Collection) map[string]map[string]bool {
+	needed := make(map[string]map[string]bool)
+	for _, c := range collectionList {
+		for _, ref := range c.References {
+			ns := ref.ns(c.DB)
+			field := ref.RefField
+			if field == "" {
+				field = "_id"
+			}
+			if needed[ns] == nil {
+				needed[ns] = make(map[string]bool)
+			}
+			needed[ns][field] = true
+		}
+	}
+	return needed
+}
+
+// refCache holds values sampled from already-generated collections, indexed
+// by namespace and field, so a collection referencing another one doesn't
+// need to re-query it for every batch
+type refCache struct {
+	mu     sync.RWMutex
+	values map[string][]interface{}
+}
+
+func newRefCache() *refCache {
+	return &refCache{values: make(map[string][]interface{})}
+}
+
+func (r *refCache) set(ns, field string, values []interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[cacheKey(ns, field)] = values
+}
+
+func (r *refCache) get(ns, field string) []interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.values[cacheKey(ns, field)]
+}
+
+func cacheKey(ns, field string) string {
+	return ns + "\x00" + field
+}
+
+// captureSamples appends values for the requested fields from a freshly
+// generated batch into samples, capped at refSampleSize per field. Called
+// from insertInDB's generation loop, so referencing collections get their
+// source values without a separate query against the collection being generated
+func captureSamples(samples map[string][]interface{}, fields map[string]bool, docs []bson.M) {
+	for field := range fields {
+		if len(samples[field]) >= refSampleSize {
+			continue
+		}
+		for _, d := range docs {
+			if len(samples[field]) >= refSampleSize {
+				break
+			}
+			if v, ok := d[field]; ok {
+				samples[field] = append(samples[field], v)
+			}
+		}
+	}
+}
+
+// applyReferences fills each field declared in coll.References with a value
+// picked at random from the referenced namespace's cached samples. Fields
+// whose referenced namespace has no cached samples (e.g. the reference was
+// declared but the target collection generated 0 matching values) are left untouched
+func applyReferences(docs []bson.M, coll *Collection, cache *refCache, source *rand.Rand) {
+	for field, ref := range coll.References {
+		refField := ref.RefField
+		if refField == "" {
+			refField = "_id"
+		}
+		values := cache.get(ref.ns(coll.DB), refField)
+		if len(values) == 0 {
+			continue
+		}
+		for _, d := range docs {
+			d[field] = values[source.Intn(len(values))]
+		}
+	}
+}
+
+// resolvePipelineValues runs every pipeline declared in coll.Pipelines
+// against its target collection and returns the resulting field values,
+// to be copied into every document generated for coll. Requires a live
+// mongodb session, so pipelines are not evaluated in file dump mode
+func resolvePipelineValues(coll *Collection, session *mgo.Session) (map[string]interface{}, error) {
+	if len(coll.Pipelines) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]interface{}, len(coll.Pipelines))
+	for field, spec := range coll.Pipelines {
+		db := spec.Database
+		if db == "" {
+			db = coll.DB
+		}
+		result := bson.M{}
+		err := session.DB(db).C(spec.Collection).Pipe(spec.Pipeline).One(&result)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't run aggregation pipeline for field %s on collection %s:\n\tcause: %s", field, coll.Name, err.Error())
+		}
+		values[field] = result[spec.Field]
+	}
+	return values, nil
+}
+
+// applyPipelineValues copies the constant field values derived from
+// resolvePipelineValues into every document of a freshly generated batch
+func applyPipelineValues(docs []bson.M, values map[string]interface{}) {
+	for field, v := range values {
+		for _, d := range docs {
+			d[field] = v
+		}
+	}
+}
+
+// resampleExistingRefs fills samples for refs.fields from documents already
+// present in the collection, used when --append resumes a collection that
+// was already fully generated in a prior run: insertInDB's generation loop
+// then runs zero iterations, so the usual captureSamples call never happens,
+// and without this, downstream collections referencing this one would
+// silently get no values for these fields. Only possible against a live
+// mongodb collection (a *mgoSink); dump-mode sinks have nothing to query
+// against, so a warning is printed instead and the fields are left unset
+func resampleExistingRefs(sink Sink, refs *crossRefs, samples map[string][]interface{}) error {
+	ms, ok := sink.(*mgoSink)
+	if !ok {
+		fields := make([]string, 0, len(refs.fields))
+		for f := range refs.fields {
+			fields = append(fields, f)
+		}
+		fmt.Printf("Warning: collection %s was already fully generated by a previous run;\n"+
+			"\tfield(s) %v can't be resampled for downstream references in dump mode,\n"+
+			"\tdocuments referencing them may be left with those fields unset\n", refs.ns, fields)
+		return nil
+	}
+	sel := bson.M{}
+	for f := range refs.fields {
+		sel[f] = 1
+	}
+	iter := ms.c.Find(nil).Select(sel).Limit(refSampleSize).Iter()
+	var doc bson.M
+	for iter.Next(&doc) {
+		for f := range refs.fields {
+			if v, ok := doc[f]; ok {
+				samples[f] = append(samples[f], v)
+			}
+		}
+		doc = nil
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("couldn't resample field(s) from already-complete collection %s:\n\tcause: %s", refs.ns, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import "testing"
+
+func TestOrderCollections(t *testing.T) {
+	cases := []struct {
+		name    string
+		colls   []Collection
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "no dependencies keeps input order",
+			colls: []Collection{
+				{DB: "test", Name: "a"},
+				{DB: "test", Name: "b"},
+			},
+			want: []string{"test.a", "test.b"},
+		},
+		{
+			name: "reference pulls dependency before dependent",
+			colls: []Collection{
+				{DB: "test", Name: "orders", References: map[string]ReferenceSpec{
+					"userId": {Collection: "users"},
+				}},
+				{DB: "test", Name: "users"},
+			},
+			want: []string{"test.users", "test.orders"},
+		},
+		{
+			name: "pipeline pulls dependency before dependent",
+			colls: []Collection{
+				{DB: "test", Name: "stats", Pipelines: map[string]PipelineSpec{
+					"total": {Collection: "orders"},
+				}},
+				{DB: "test", Name: "orders"},
+			},
+			want: []string{"test.orders", "test.stats"},
+		},
+		{
+			name: "unknown collection referenced",
+			colls: []Collection{
+				{DB: "test", Name: "orders", References: map[string]ReferenceSpec{
+					"userId": {Collection: "users"},
+				}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "circular reference",
+			colls: []Collection{
+				{DB: "test", Name: "a", References: map[string]ReferenceSpec{
+					"bId": {Collection: "b"},
+				}},
+				{DB: "test", Name: "b", References: map[string]ReferenceSpec{
+					"aId": {Collection: "a"},
+				}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := orderCollections(tc.colls)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d collections, want %d", len(got), len(tc.want))
+			}
+			for i, c := range got {
+				ns := c.DB + "." + c.Name
+				if ns != tc.want[i] {
+					t.Errorf("position %d: got %s, want %s", i, ns, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNeededRefFields(t *testing.T) {
+	colls := []Collection{
+		{DB: "test", Name: "orders", References: map[string]ReferenceSpec{
+			"userId":    {Collection: "users"},
+			"productId": {Collection: "products", RefField: "sku"},
+		}},
+		{DB: "test", Name: "returns", References: map[string]ReferenceSpec{
+			"orderUserId": {Collection: "users"},
+		}},
+	}
+	needed := neededRefFields(colls)
+
+	users, ok := needed["test.users"]
+	if !ok {
+		t.Fatalf("expected test.users to be a needed namespace")
+	}
+	if !users["_id"] {
+		t.Errorf("expected test.users to need the default '_id' field")
+	}
+
+	products, ok := needed["test.products"]
+	if !ok {
+		t.Fatalf("expected test.products to be a needed namespace")
+	}
+	if !products["sku"] {
+		t.Errorf("expected test.products to need the 'sku' field")
+	}
+}
+
+func TestResampleExistingRefsDumpModeLeavesSamplesEmpty(t *testing.T) {
+	refs := &crossRefs{cache: newRefCache(), ns: "test.users", fields: map[string]bool{"_id": true}}
+	samples := make(map[string][]interface{})
+	fs := &fileSink{format: "json"}
+	if err := resampleExistingRefs(fs, refs, samples); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("expected no samples to be collected in dump mode, got %v", samples)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+)
+
+// splitMix64 is a fast, well-distributed 64 bit mix function, used here to
+// derive independent per-batch seeds from a single global seed
+func splitMix64(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// effectiveSeed resolves the seed to use for a collection, giving priority
+// to the per-collection `seed` over the CLI-level --seed. 0 means "no seed
+// requested", in which case the caller should fall back to rg.NewRandSource()
+func effectiveSeed(coll *Collection, cliSeed int64) int64 {
+	if coll.Seed != 0 {
+		return coll.Seed
+	}
+	return cliSeed
+}
+
+// batchSource returns the rand.Rand to use for a given batch of collection
+// ns. When seed is 0, it returns nil so the caller falls back to
+// rg.NewRandSource(); otherwise it derives a seed unique to this batch with
+// splitMix64, so the same config and seed always produce the same documents
+// for each batch index. ns is mixed into the derivation so
+// collections sharing the CLI-level --seed still get independent,
+// non-identical document sequences instead of colliding on batch index alone
+func batchSource(seed int64, ns string, batchIndex int) *rand.Rand {
+	if seed == 0 {
+		return nil
+	}
+	nsSeed := splitMix64(uint64(seed) ^ fnv64a(ns))
+	batchSeed := int64(splitMix64(nsSeed + uint64(batchIndex)))
+	return rand.New(rand.NewSource(batchSeed))
+}
+
+// fnv64a hashes s with FNV-1a, used to mix a collection's namespace into its
+// seed derivation
+func fnv64a(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
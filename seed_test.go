@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestSplitMix64Deterministic(t *testing.T) {
+	a := splitMix64(42)
+	b := splitMix64(42)
+	if a != b {
+		t.Fatalf("splitMix64 is not deterministic: %d != %d", a, b)
+	}
+}
+
+func TestSplitMix64Distinct(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for x := uint64(0); x < 1000; x++ {
+		v := splitMix64(x)
+		if seen[v] {
+			t.Fatalf("splitMix64(%d) collided with an earlier output: %d", x, v)
+		}
+		seen[v] = true
+	}
+}
+
+func TestBatchSourceNilWhenUnseeded(t *testing.T) {
+	if s := batchSource(0, "test.coll", 0); s != nil {
+		t.Fatalf("expected a nil source when seed is 0, got %v", s)
+	}
+}
+
+func TestBatchSourceDeterministic(t *testing.T) {
+	s1 := batchSource(7, "test.coll", 3)
+	s2 := batchSource(7, "test.coll", 3)
+	if s1 == nil || s2 == nil {
+		t.Fatalf("expected non-nil sources for a non-zero seed")
+	}
+	for i := 0; i < 10; i++ {
+		a, b := s1.Int63(), s2.Int63()
+		if a != b {
+			t.Fatalf("same seed+ns+batchIndex produced different sequences: %d != %d", a, b)
+		}
+	}
+}
+
+func TestBatchSourceVariesByBatchIndex(t *testing.T) {
+	s1 := batchSource(7, "test.coll", 0)
+	s2 := batchSource(7, "test.coll", 1)
+	if s1.Int63() == s2.Int63() {
+		t.Fatalf("expected different batch indices to produce different sequences")
+	}
+}
+
+// TestBatchSourceVariesByCollection guards against two collections that
+// share the CLI-level --seed producing byte-identical document sequences:
+// ns must be mixed into the derivation so each collection is independently
+// seeded even without a per-collection `seed` override
+func TestBatchSourceVariesByCollection(t *testing.T) {
+	s1 := batchSource(7, "test.users", 0)
+	s2 := batchSource(7, "test.orders", 0)
+	if s1.Int63() == s2.Int63() {
+		t.Fatalf("expected different collections to produce different sequences for the same seed and batch index")
+	}
+}
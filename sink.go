@@ -0,0 +1,334 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Sink is the destination generated documents are written to. insertInDB()
+// doesn't need to know whether it's talking to a live mongodb server or
+// writing to disk, it just pushes batches of documents to a Sink
+type Sink interface {
+	// Insert writes a batch of generated documents for the collection this
+	// sink was created for
+	Insert(docs []bson.M) error
+	// Close flushes any buffered data and releases underlying resources.
+	// Called once, after the last call to Insert
+	Close() error
+}
+
+// OutputOptions stores the CLI flags that select a file-based Sink instead
+// of the default live mongodb connection
+type OutputOptions struct {
+	OutDir     string `long:"out" value-name:"<dir>" description:"write generated documents to <dir> instead of a live\n mongodb server: one <collection>.<outputType> per collection,\n plus <collection>.metadata.json for bson, which is\n mongorestore-compatible"`
+	Archive    string `long:"archive" value-name:"<path>" description:"write generated documents for all collections into a\n single archive file instead of a live mongodb server.\n Use '-' to write to stdout. This is mgodatagen's own\n streaming format, NOT compatible with mongorestore --archive;\n use --out with outputType bson for a mongorestore-compatible dump"`
+	OutputType string `long:"outputType" value-name:"<type>" description:"format to use with --out, one of bson|json|csv" default:"bson"`
+	Gzip       bool   `long:"gzip" description:"gzip compress the output produced by --out or --archive"`
+}
+
+// dumpRequested returns true when the CLI asked for a file sink rather than
+// a live mongodb connection
+func (o *OutputOptions) dumpRequested() bool {
+	return o.OutDir != "" || o.Archive != ""
+}
+
+// mgoSink inserts generated documents into a live mongodb collection. This
+// is the historical behavior of insertInDB, extracted behind Sink so it can
+// be swapped for a file-based sink
+type mgoSink struct {
+	c       *mgo.Collection
+	ordered bool
+}
+
+// newMgoSink sets the effective write concern on the collection's session
+// and returns a Sink that bulk inserts into it
+func newMgoSink(c *mgo.Collection, wc *mgo.Safe, ordered bool) Sink {
+	c.Database.Session.SetSafe(wc)
+	return &mgoSink{c: c, ordered: ordered}
+}
+
+func (s *mgoSink) Insert(docs []bson.M) error {
+	bulk := s.c.Bulk()
+	if !s.ordered {
+		bulk.Unordered()
+	}
+	for i := range docs {
+		bulk.Insert(docs[i])
+	}
+	_, err := bulk.Run()
+	if err != nil {
+		return fmt.Errorf("exception occurred during bulk insert:\n\tcause: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *mgoSink) Close() error {
+	return nil
+}
+
+// fileSink writes generated documents for a single collection to disk, as
+// mongorestore-compatible bson (raw concatenated bson documents plus a
+// metadata.json sidecar), newline-delimited json, or csv
+type fileSink struct {
+	format string
+	w      io.Writer
+	closer func() error
+	csvW   *csv.Writer
+	header []string
+	// skipHeader is set when reopening an existing csv file in append mode,
+	// so the header row (already present from the previous run) isn't
+	// re-written into the middle of the file
+	skipHeader bool
+}
+
+// newFileSink creates (or, in append mode, reopens) the output file for coll
+// under opts.OutDir, writing a metadata.json sidecar for bson output, and
+// returns a Sink that writes to it. appendMode is only meaningful when
+// resuming a previous run: gzip-compressed output can't be resumed mid-file,
+// so --append is only supported for plain (non-gzip) file output
+func newFileSink(coll *Collection, opts *OutputOptions, appendMode bool) (Sink, error) {
+	if err := os.MkdirAll(opts.OutDir, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create output directory %s:\n\tcause: %s", opts.OutDir, err.Error())
+	}
+	name := filepath.Join(opts.OutDir, coll.Name+"."+opts.OutputType)
+	if opts.Gzip {
+		name += ".gz"
+		if appendMode {
+			return nil, fmt.Errorf("--append is not supported together with --gzip for collection %s", coll.Name)
+		}
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendMode {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(name, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open output file %s:\n\tcause: %s", name, err.Error())
+	}
+	w, closer := wrapGzip(f, opts.Gzip)
+	fs := &fileSink{format: opts.OutputType, w: w, closer: closer, skipHeader: appendMode}
+	if opts.OutputType == "csv" {
+		fs.csvW = csv.NewWriter(w)
+	}
+	if opts.OutputType == "bson" && !appendMode {
+		if err := writeDumpMetadata(opts.OutDir, coll); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// wrapGzip optionally wraps w with a gzip.Writer, returning a close function
+// that closes the gzip writer (if any) before the underlying file
+func wrapGzip(f *os.File, gz bool) (io.Writer, func() error) {
+	if !gz {
+		return f, f.Close
+	}
+	gzw := gzip.NewWriter(f)
+	return gzw, func() error {
+		if err := gzw.Close(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+}
+
+// writeDumpMetadata writes a minimal mongorestore-compatible metadata.json
+// next to a bson dump file, so the indexes declared in the config are
+// recreated by `mongorestore`
+func writeDumpMetadata(dir string, coll *Collection) error {
+	// Index only has bson tags, so round-trip each one through bson to get
+	// the field names mongorestore expects (name, key, unique, ...)
+	indexes := make([]bson.M, 0, len(coll.Indexes))
+	for _, idx := range coll.Indexes {
+		var m bson.M
+		raw, err := bson.Marshal(idx)
+		if err == nil {
+			err = bson.Unmarshal(raw, &m)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't convert index %s for collection %s:\n\tcause: %s", idx.Name, coll.Name, err.Error())
+		}
+		indexes = append(indexes, m)
+	}
+	meta := struct {
+		Indexes []bson.M `json:"indexes"`
+	}{Indexes: indexes}
+	raw, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal metadata for collection %s:\n\tcause: %s", coll.Name, err.Error())
+	}
+	path := filepath.Join(dir, coll.Name+".metadata.json")
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		return fmt.Errorf("couldn't write metadata file %s:\n\tcause: %s", path, err.Error())
+	}
+	return nil
+}
+
+func (fs *fileSink) Insert(docs []bson.M) error {
+	switch fs.format {
+	case "bson":
+		for _, d := range docs {
+			raw, err := bson.Marshal(d)
+			if err != nil {
+				return fmt.Errorf("couldn't marshal document to bson:\n\tcause: %s", err.Error())
+			}
+			if _, err := fs.w.Write(raw); err != nil {
+				return fmt.Errorf("couldn't write bson document:\n\tcause: %s", err.Error())
+			}
+		}
+	case "json":
+		for _, d := range docs {
+			raw, err := json.Marshal(d)
+			if err != nil {
+				return fmt.Errorf("couldn't marshal document to json:\n\tcause: %s", err.Error())
+			}
+			if _, err := fs.w.Write(append(raw, '\n')); err != nil {
+				return fmt.Errorf("couldn't write json document:\n\tcause: %s", err.Error())
+			}
+		}
+	case "csv":
+		for _, d := range docs {
+			if fs.header == nil {
+				fs.header = sortedKeys(d)
+				if !fs.skipHeader {
+					if err := fs.csvW.Write(fs.header); err != nil {
+						return fmt.Errorf("couldn't write csv header:\n\tcause: %s", err.Error())
+					}
+				}
+			}
+			row := make([]string, len(fs.header))
+			for i, k := range fs.header {
+				row[i] = fmt.Sprintf("%v", d[k])
+			}
+			if err := fs.csvW.Write(row); err != nil {
+				return fmt.Errorf("couldn't write csv row:\n\tcause: %s", err.Error())
+			}
+		}
+		// flush every batch, so rows the checkpoint counts as written are
+		// in the file rather than in the csv.Writer's buffer
+		fs.csvW.Flush()
+		if err := fs.csvW.Error(); err != nil {
+			return fmt.Errorf("couldn't flush csv rows:\n\tcause: %s", err.Error())
+		}
+	default:
+		return fmt.Errorf("unknown outputType %q, expected bson|json|csv", fs.format)
+	}
+	return nil
+}
+
+func (fs *fileSink) Close() error {
+	if fs.csvW != nil {
+		fs.csvW.Flush()
+		if err := fs.csvW.Error(); err != nil {
+			return err
+		}
+	}
+	return fs.closer()
+}
+
+// sortedKeys returns the keys of d in sorted order, used to build a stable
+// csv header from the first document written
+func sortedKeys(d bson.M) []string {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// archiveWriter is the single underlying writer used by --archive mode. It
+// is shared by every collection's archiveSink so that all of them end up in
+// the same file
+type archiveWriter struct {
+	w      io.Writer
+	closer func() error
+}
+
+// newArchiveWriter opens opts.Archive (or stdout, for "-") and wraps it with
+// gzip if requested. resuming is true when a checkpoint already has progress
+// recorded for one of the collections being dumped: --archive interleaves
+// every collection's documents into a single file, so there's no way to
+// reopen it mid-stream and append only the missing documents without
+// corrupting the frames already written, unlike --out's one-file-per-collection
+func newArchiveWriter(opts *OutputOptions, resuming bool) (*archiveWriter, error) {
+	if resuming {
+		return nil, fmt.Errorf("--append is not supported together with --archive")
+	}
+	if opts.Archive == "-" {
+		w, closer := wrapGzipWriter(os.Stdout, opts.Gzip, func() error { return nil })
+		return &archiveWriter{w: w, closer: closer}, nil
+	}
+	f, err := os.Create(opts.Archive)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create archive file %s:\n\tcause: %s", opts.Archive, err.Error())
+	}
+	w, closer := wrapGzip(f, opts.Gzip)
+	return &archiveWriter{w: w, closer: closer}, nil
+}
+
+// wrapGzipWriter is like wrapGzip but for a writer that isn't an *os.File
+// (stdout), delegating the final close step to fallback
+func wrapGzipWriter(w io.Writer, gz bool, fallback func() error) (io.Writer, func() error) {
+	if !gz {
+		return w, fallback
+	}
+	gzw := gzip.NewWriter(w)
+	return gzw, func() error {
+		if err := gzw.Close(); err != nil {
+			return err
+		}
+		return fallback()
+	}
+}
+
+func (a *archiveWriter) Close() error {
+	return a.closer()
+}
+
+// archiveSink writes one collection's documents into a shared archiveWriter,
+// framing each document with its namespace and byte length. This is a
+// custom streaming container, not byte-compatible with `mongorestore
+// --archive`, but is trivial to replay with a small reader
+type archiveSink struct {
+	ns string
+	a  *archiveWriter
+}
+
+func newArchiveSink(a *archiveWriter, db, collName string) Sink {
+	return &archiveSink{ns: db + "." + collName, a: a}
+}
+
+func (s *archiveSink) Insert(docs []bson.M) error {
+	for _, d := range docs {
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			return fmt.Errorf("couldn't marshal document to bson:\n\tcause: %s", err.Error())
+		}
+		header := fmt.Sprintf("%s\x00%d\x00", s.ns, len(raw))
+		if _, err := s.a.w.Write([]byte(header)); err != nil {
+			return fmt.Errorf("couldn't write archive frame header:\n\tcause: %s", err.Error())
+		}
+		if _, err := s.a.w.Write(raw); err != nil {
+			return fmt.Errorf("couldn't write archive frame body:\n\tcause: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// Close is a no-op: the underlying archiveWriter is shared across
+// collections and closed once by the caller after the whole run completes
+func (s *archiveSink) Close() error {
+	return nil
+}
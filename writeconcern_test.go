@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo"
+)
+
+func TestEffectiveWriteConcern(t *testing.T) {
+	cases := []struct {
+		name    string
+		coll    *Collection
+		opts    *WriteConcernOptions
+		replSet bool
+		want    *mgo.Safe
+	}{
+		{
+			name:    "no flags, standalone, defaults to w:1",
+			coll:    &Collection{},
+			opts:    &WriteConcernOptions{},
+			replSet: false,
+			want:    &mgo.Safe{W: 1},
+		},
+		{
+			name:    "no flags, replica set, defaults to majority",
+			coll:    &Collection{},
+			opts:    &WriteConcernOptions{},
+			replSet: true,
+			want:    &mgo.Safe{WMode: "majority"},
+		},
+		{
+			name:    "journal alone still applies J without an explicit -w",
+			coll:    &Collection{},
+			opts:    &WriteConcernOptions{Journal: true},
+			replSet: false,
+			want:    &mgo.Safe{W: 1, J: true},
+		},
+		{
+			name:    "fsync and wtimeout alone still apply without an explicit -w",
+			coll:    &Collection{},
+			opts:    &WriteConcernOptions{FSync: true, WTimeout: 5000},
+			replSet: true,
+			want:    &mgo.Safe{WMode: "majority", FSync: true, WTimeout: 5000},
+		},
+		{
+			name:    "explicit -w is honored as-is",
+			coll:    &Collection{},
+			opts:    &WriteConcernOptions{W: "2", Journal: true},
+			replSet: true,
+			want:    &mgo.Safe{W: 2, J: true},
+		},
+		{
+			name: "per-collection writeConcern overrides CLI flags entirely",
+			coll: &Collection{WriteConcern: &WriteConcern{W: "3"}},
+			opts: &WriteConcernOptions{Journal: true, FSync: true},
+			want: &mgo.Safe{W: 3},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := effectiveWriteConcern(tc.coll, tc.opts, tc.replSet)
+			if *got != *tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}